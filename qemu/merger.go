@@ -0,0 +1,275 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package qemukernel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBootPattern is used when QemuSystem.BootPattern is left unset.
+var defaultBootPattern = regexp.MustCompile(`login:`)
+
+// endOfTrace closes an oops/panic block collected into KernelPanicReport.
+const endOfTrace = "---[ end trace"
+
+// PanicPattern names a regex that, once matched on a console line, marks
+// the start of a kernel oops/panic/OOM block. Exported so callers can
+// override QemuSystem.PanicPatterns/OOMPatterns for rootfses that print
+// non-mainline markers.
+type PanicPattern struct {
+	Kind    string
+	Pattern *regexp.Regexp
+}
+
+// defaultPanicPatterns covers the oops/panic markers common across
+// mainline kernels with the debug options out-of-tree tests care about.
+var defaultPanicPatterns = []PanicPattern{
+	{"Kernel panic", regexp.MustCompile(`Kernel panic`)},
+	{"BUG", regexp.MustCompile(`BUG:`)},
+	{"WARNING", regexp.MustCompile(`WARNING:`)},
+	{"Unable to handle kernel", regexp.MustCompile(`Unable to handle kernel`)},
+	{"general protection fault", regexp.MustCompile(`general protection fault`)},
+	{"KASAN", regexp.MustCompile(`KASAN:`)},
+	{"KFENCE", regexp.MustCompile(`KFENCE:`)},
+	{"UBSAN", regexp.MustCompile(`UBSAN:`)},
+	{"lockdep", regexp.MustCompile(`possible recursive locking detected`)},
+}
+
+// defaultOOMPatterns fire immediately, on a single line, rather than
+// opening a multi-line trace collection like defaultPanicPatterns.
+var defaultOOMPatterns = []PanicPattern{
+	{"OOM", regexp.MustCompile(`Out of memory`)},
+	{"OOM", regexp.MustCompile(`oom-killer`)},
+}
+
+func matchAny(patterns []PanicPattern, line string) (kind string, ok bool) {
+	for _, p := range patterns {
+		if p.Pattern.MatchString(line) {
+			return p.Kind, true
+		}
+	}
+	return "", false
+}
+
+// panicScanner holds the running state of the oops/panic/OOM block
+// collector used by outputWatcher, factored out so it can be fed canned
+// lines directly in tests without needing a live qemu process.
+type panicScanner struct {
+	collecting bool
+	kind       string
+	firstLine  string
+	trace      []string
+
+	// PanicPatterns/OOMPatterns override the package defaults when set,
+	// left nil to use defaultPanicPatterns/defaultOOMPatterns.
+	PanicPatterns []PanicPattern
+	OOMPatterns   []PanicPattern
+}
+
+// feed processes one console line. ok is true once a full block has been
+// collected (a panic pattern through its closing "---[ end trace" marker,
+// or a single OOM line), in which case ev describes it.
+func (s *panicScanner) feed(line string) (ev Event, ok bool) {
+	panicPatterns := s.PanicPatterns
+	if panicPatterns == nil {
+		panicPatterns = defaultPanicPatterns
+	}
+	oomPatterns := s.OOMPatterns
+	if oomPatterns == nil {
+		oomPatterns = defaultOOMPatterns
+	}
+
+	if s.collecting {
+		s.trace = append(s.trace, line)
+		if strings.Contains(line, endOfTrace) {
+			return s.finish(), true
+		}
+		return Event{}, false
+	}
+
+	if k, matched := matchAny(panicPatterns, line); matched {
+		s.collecting, s.kind, s.firstLine, s.trace = true, k, line, []string{line}
+		return Event{}, false
+	}
+
+	if k, matched := matchAny(oomPatterns, line); matched {
+		s.kind, s.firstLine, s.trace = k, line, []string{line}
+		return s.finish(), true
+	}
+
+	return Event{}, false
+}
+
+// flush returns the block collected so far, if one was in progress when
+// the console stopped producing lines (e.g. qemu exited without ever
+// printing the closing "---[ end trace" marker).
+func (s *panicScanner) flush() (ev Event, ok bool) {
+	if !s.collecting {
+		return Event{}, false
+	}
+	return s.finish(), true
+}
+
+func (s *panicScanner) finish() Event {
+	return Event{
+		Kind:      PanicEvent,
+		PanicKind: s.kind,
+		FirstLine: s.firstLine,
+		FullTrace: strings.Join(s.trace, "\n"),
+	}
+}
+
+// outputLine is a single line read off one of qemu's output streams,
+// tagged with which stream produced it.
+type outputLine struct {
+	stderr bool
+	text   string
+}
+
+// outputMerger fans stdout and stderr into a single ordered channel of
+// tagged lines for pattern matching.
+type outputMerger struct {
+	lines chan outputLine
+	wg    sync.WaitGroup
+}
+
+func newOutputMerger() *outputMerger {
+	return &outputMerger{lines: make(chan outputLine, 256)}
+}
+
+// Add scans r line by line, forwarding each line to m.lines until r hits
+// EOF.
+func (m *outputMerger) Add(stderr bool, r io.Reader) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 4096), 1<<20)
+		for scanner.Scan() {
+			m.lines <- outputLine{stderr: stderr, text: scanner.Text()}
+		}
+	}()
+}
+
+// Wait closes m.lines once every stream added via Add has hit EOF.
+func (m *outputMerger) Wait() {
+	m.wg.Wait()
+	close(m.lines)
+}
+
+// drain keeps reading off lines until it's closed, so a scanning goroutine
+// blocked on a send never leaks after outputWatcher has stopped consuming
+// (e.g. once it has returned early on a detected panic).
+func drain(lines <-chan outputLine) {
+	for range lines {
+	}
+}
+
+// EventKind identifies what kind of Event was emitted on QemuSystem.Events.
+type EventKind int
+
+const (
+	// BootEvent fires once, when BootPattern first matches.
+	BootEvent EventKind = iota
+	// PanicEvent fires when a kernel oops/panic/OOM pattern matches.
+	PanicEvent
+)
+
+// Event is delivered on QemuSystem.Events as boot/panic conditions are
+// detected in the guest's console output.
+type Event struct {
+	Kind EventKind
+
+	// PanicKind, FirstLine and FullTrace are only set on PanicEvent:
+	// PanicKind names which pattern matched (e.g. "KASAN"), FirstLine is the line
+	// that tripped it, and FullTrace holds every line collected from
+	// there through the trailing "---[ end trace" marker (or up to
+	// whatever was printed before qemu exited, if that marker never
+	// shows up).
+	PanicKind string
+	FirstLine string
+	FullTrace string
+}
+
+func (q *QemuSystem) emit(ev Event) {
+	select {
+	case q.Events <- ev:
+	default: // drop if nobody is listening
+	}
+}
+
+func (q *QemuSystem) appendOutput(line outputLine) {
+	buf := &q.Stdout
+	if line.stderr {
+		buf = &q.Stderr
+	}
+	*buf = append(*buf, []byte(line.text+"\n")...)
+}
+
+// WaitForBoot blocks until BootPattern matches a console line, or timeout
+// elapses, replacing the previous time.Sleep-based race before the first
+// ssh call.
+func (q *QemuSystem) WaitForBoot(timeout time.Duration) error {
+	select {
+	case <-q.booted:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timeout waiting for boot marker on %s", q.sshAddrPort)
+	}
+}
+
+// outputWatcher replaces the previous bytes.Contains polling loop with a
+// line-oriented merger: it watches the merged stdout/stderr stream for the
+// boot marker and for oops/panic/OOM patterns, collecting a full trace
+// for the latter into KernelPanicReport.
+func (q *QemuSystem) outputWatcher() {
+	merger := newOutputMerger()
+	merger.Add(false, q.pipe.stdout)
+	merger.Add(true, q.pipe.stderr)
+	go merger.Wait()
+
+	bootPattern := q.BootPattern
+	if bootPattern == nil {
+		bootPattern = defaultBootPattern
+	}
+
+	booted := false
+	scanner := panicScanner{PanicPatterns: q.PanicPatterns, OOMPatterns: q.OOMPatterns}
+
+	for line := range merger.lines {
+		q.appendOutput(line)
+
+		if !booted && bootPattern.MatchString(line.text) {
+			booted = true
+			close(q.booted)
+			q.emit(Event{Kind: BootEvent})
+		}
+
+		if ev, ok := scanner.feed(line.text); ok {
+			q.KernelPanic = true
+			q.KernelPanicReport = ev.FullTrace
+			q.emit(ev)
+			q.Stop()
+			go drain(merger.lines)
+			return
+		}
+	}
+
+	// qemu exited on its own (e.g. a clean shutdown, or a panic that
+	// never printed the closing "---[ end trace" marker); flush whatever
+	// partial trace we collected so callers still see it
+	if ev, ok := scanner.flush(); ok {
+		q.KernelPanic = true
+		q.KernelPanicReport = ev.FullTrace
+		q.emit(ev)
+	}
+}
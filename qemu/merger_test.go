@@ -0,0 +1,143 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package qemukernel
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPanicScannerCollectsTraceUntilEndMarker(t *testing.T) {
+	var s panicScanner
+
+	lines := []string{
+		"booting...",
+		"BUG: unable to handle kernel NULL pointer dereference",
+		"Call Trace:",
+		" foo+0x10/0x20",
+		"---[ end trace 0000000000000000 ]---",
+	}
+
+	for i, line := range lines[:len(lines)-1] {
+		if ev, ok := s.feed(line); ok {
+			t.Fatalf("feed(%q) (line %d) reported done early: %+v", line, i, ev)
+		}
+	}
+
+	ev, ok := s.feed(lines[len(lines)-1])
+	if !ok {
+		t.Fatal("feed did not report a completed block on the end-trace marker")
+	}
+
+	if ev.Kind != PanicEvent {
+		t.Errorf("Kind = %v, want PanicEvent", ev.Kind)
+	}
+	if ev.PanicKind != "BUG" {
+		t.Errorf("PanicKind = %q, want %q", ev.PanicKind, "BUG")
+	}
+	if ev.FirstLine != lines[1] {
+		t.Errorf("FirstLine = %q, want %q", ev.FirstLine, lines[1])
+	}
+	if ev.FullTrace != strings.Join(lines[1:], "\n") {
+		t.Errorf("FullTrace = %q, want %q", ev.FullTrace, strings.Join(lines[1:], "\n"))
+	}
+}
+
+func TestPanicScannerOOMFiresOnSingleLine(t *testing.T) {
+	var s panicScanner
+
+	if ev, ok := s.feed("something something oom-killer invoked"); !ok || ev.PanicKind != "OOM" {
+		t.Fatalf("feed() = %+v, %v, want an OOM event", ev, ok)
+	}
+}
+
+func TestPanicScannerFlushReturnsPartialTrace(t *testing.T) {
+	var s panicScanner
+
+	if _, ok := s.feed("KASAN: use-after-free in foo"); ok {
+		t.Fatal("feed reported done before the end-trace marker")
+	}
+
+	ev, ok := s.flush()
+	if !ok {
+		t.Fatal("flush() found nothing to report for an in-progress block")
+	}
+	if ev.PanicKind != "KASAN" {
+		t.Errorf("PanicKind = %q, want %q", ev.PanicKind, "KASAN")
+	}
+	if ev.FullTrace != "KASAN: use-after-free in foo" {
+		t.Errorf("FullTrace = %q", ev.FullTrace)
+	}
+
+	if _, ok := (&panicScanner{}).flush(); ok {
+		t.Fatal("flush() on a scanner with no pending block should report nothing")
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	if _, ok := matchAny(defaultPanicPatterns, "nothing interesting here"); ok {
+		t.Fatal("matched a plain line against panic patterns")
+	}
+
+	if kind, ok := matchAny(defaultPanicPatterns, "general protection fault: 0000"); !ok || kind == "" {
+		t.Fatalf("matchAny() = %q, %v, want a match", kind, ok)
+	}
+}
+
+func TestOutputMergerTagsAndOrdersLines(t *testing.T) {
+	m := newOutputMerger()
+
+	stdout := strings.NewReader("out1\nout2\n")
+	stderr := strings.NewReader("err1\n")
+
+	m.Add(false, stdout)
+	m.Add(true, stderr)
+	go m.Wait()
+
+	var got []outputLine
+	timeout := time.After(2 * time.Second)
+loop:
+	for {
+		select {
+		case line, ok := <-m.lines:
+			if !ok {
+				break loop
+			}
+			got = append(got, line)
+		case <-timeout:
+			t.Fatal("timed out waiting for merged output")
+		}
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("got %d lines, want 3: %+v", len(got), got)
+	}
+
+	var texts, stdoutTexts []string
+	for _, l := range got {
+		texts = append(texts, l.text)
+
+		wantStderr := strings.HasPrefix(l.text, "err")
+		if l.stderr != wantStderr {
+			t.Errorf("line %q tagged stderr=%v, want %v", l.text, l.stderr, wantStderr)
+		}
+		if !l.stderr {
+			stdoutTexts = append(stdoutTexts, l.text)
+		}
+	}
+	if len(stdoutTexts) != 2 || stdoutTexts[0] != "out1" || stdoutTexts[1] != "out2" {
+		t.Errorf("stdout lines = %v, want [out1 out2] in order", stdoutTexts)
+	}
+	sort.Strings(texts)
+	want := []string{"err1", "out1", "out2"}
+	for i := range want {
+		if texts[i] != want[i] {
+			t.Errorf("texts = %v, want %v", texts, want)
+			break
+		}
+	}
+}
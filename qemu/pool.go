@@ -0,0 +1,265 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package qemukernel
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+// PoolConfig describes how to build the QemuSystem instances a Pool hands
+// out, mirroring the parameters NewQemuSystem itself takes.
+type PoolConfig struct {
+	Arch      arch
+	Kernel    Kernel
+	BaseDrive string
+
+	Cpus    int
+	Memory  int
+	SSHKey  string
+	SSHUser string
+	Timeout time.Duration
+
+	// BootTimeout bounds how long Acquire waits for a freshly started
+	// instance to boot, defaults to defaultPoolBootTimeout when zero.
+	BootTimeout time.Duration
+
+	// OverlayDir holds the per-instance qcow2 overlays, defaults to
+	// os.TempDir() when empty.
+	OverlayDir string
+
+	// BootPattern overrides QemuSystem.BootPattern for every instance in
+	// the pool, left nil to use the default login-prompt regex.
+	BootPattern *regexp.Regexp
+
+	// PanicPatterns/OOMPatterns override QemuSystem.PanicPatterns/
+	// OOMPatterns for every instance in the pool, left nil to use the
+	// package defaults.
+	PanicPatterns []PanicPattern
+	OOMPatterns   []PanicPattern
+}
+
+const defaultPoolBootTimeout = 60 * time.Second
+
+// poolSnapshotName is the QMP snapshot saved right after an instance's
+// first successful boot, so later Acquires can reset guest state with a
+// LoadSnapshot instead of paying boot cost again.
+const poolSnapshotName = "pool-clean"
+
+// poolInstance tracks one VM owned by a Pool, alongside the overlay image
+// backing its drive so it can be torn down and rebuilt.
+type poolInstance struct {
+	q       *QemuSystem
+	overlay string
+
+	// snapshotted is true once poolSnapshotName has been saved for q,
+	// meaning Acquire can LoadSnapshot instead of rebooting from scratch.
+	snapshotted bool
+}
+
+func (inst *poolInstance) teardown() {
+	if inst.q.cmd != nil && !inst.q.Died {
+		inst.q.Stop()
+	}
+	os.Remove(inst.overlay)
+}
+
+// Pool manages a fixed number of QemuSystem instances, each booted off its
+// own COW overlay of the base drive so tests don't collide, letting
+// callers fan out across cores instead of running one VM at a time.
+type Pool struct {
+	cfg  PoolConfig
+	free chan *poolInstance
+
+	// lost counts slots whose instance could not be rebuilt (e.g. the
+	// disk was full when qemu-img tried to create a replacement overlay)
+	// and were never returned to free, so Close knows not to wait for
+	// them.
+	lost int32
+
+	// newInstanceFn/bootInstanceFn default to p.newInstance and
+	// p.bootInstance, overridden in tests to drive Acquire's state
+	// machine without a real qemu-img/qemu binary.
+	newInstanceFn  func() (*poolInstance, error)
+	bootInstanceFn func(*QemuSystem) error
+}
+
+// NewPool creates a Pool of count VMs built from cfg. Each instance gets
+// its own qcow2 overlay backed by cfg.BaseDrive; instances are started
+// lazily, the first time they are Acquired.
+func NewPool(count int, cfg PoolConfig) (p *Pool, err error) {
+	if count <= 0 {
+		return nil, fmt.Errorf("pool: count must be positive, got %d", count)
+	}
+
+	if _, err = os.Stat(cfg.BaseDrive); err != nil {
+		return
+	}
+
+	p = &Pool{cfg: cfg, free: make(chan *poolInstance, count)}
+	p.newInstanceFn = p.newInstance
+	p.bootInstanceFn = p.bootInstance
+
+	for i := 0; i < count; i++ {
+		var inst *poolInstance
+		if inst, err = p.newInstanceFn(); err != nil {
+			close(p.free)
+			for leftover := range p.free {
+				leftover.teardown()
+			}
+			return nil, err
+		}
+		p.free <- inst
+	}
+
+	return p, nil
+}
+
+func (p *Pool) overlayDir() string {
+	if p.cfg.OverlayDir != "" {
+		return p.cfg.OverlayDir
+	}
+	return os.TempDir()
+}
+
+func (p *Pool) newInstance() (inst *poolInstance, err error) {
+	overlay := filepath.Join(p.overlayDir(), fmt.Sprintf("pool-overlay-%d.qcow2", rand.Int()))
+
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2",
+		"-b", p.cfg.BaseDrive, "-F", "qcow2", overlay)
+	if output, cmdErr := cmd.CombinedOutput(); cmdErr != nil {
+		return nil, fmt.Errorf("pool: qemu-img create: %s: %w", output, cmdErr)
+	}
+
+	q, err := NewQemuSystem(p.cfg.Arch, p.cfg.Kernel, overlay)
+	if err != nil {
+		os.Remove(overlay)
+		return nil, err
+	}
+
+	if p.cfg.Cpus != 0 {
+		q.Cpus = p.cfg.Cpus
+	}
+	if p.cfg.Memory != 0 {
+		q.Memory = p.cfg.Memory
+	}
+	q.SSHKey = p.cfg.SSHKey
+	q.SSHUser = p.cfg.SSHUser
+	q.Timeout = p.cfg.Timeout
+	if p.cfg.BootPattern != nil {
+		q.BootPattern = p.cfg.BootPattern
+	}
+	q.PanicPatterns = p.cfg.PanicPatterns
+	q.OOMPatterns = p.cfg.OOMPatterns
+
+	return &poolInstance{q: q, overlay: overlay}, nil
+}
+
+// recycle tears down inst's VM and overlay and builds a fresh instance in
+// its place. Used when an instance comes back from Acquire having
+// panicked or been killed by its own timeout.
+func (p *Pool) recycle(inst *poolInstance) (*poolInstance, error) {
+	inst.teardown()
+	return p.newInstanceFn()
+}
+
+// returnBroken recycles inst after it failed to start, boot or restore its
+// snapshot, so the next Acquire gets a fresh instance instead of silently
+// handing the same half-booted QemuSystem back out forever. origErr is
+// what's returned to the current caller; a recycle failure is reported
+// instead and shrinks the pool via p.lost, same as Acquire's
+// Died/KernelPanic/KilledByTimeout path.
+func (p *Pool) returnBroken(inst *poolInstance, origErr error) (*QemuSystem, func(), error) {
+	fresh, err := p.recycle(inst)
+	if err != nil {
+		atomic.AddInt32(&p.lost, 1)
+		return nil, nil, err
+	}
+	p.free <- fresh
+	return nil, nil, origErr
+}
+
+// bootInstance starts q and waits for it to boot, the real
+// Pool.bootInstanceFn implementation; overridden in tests so Acquire's
+// start/boot failure handling can be exercised without a real qemu
+// binary.
+func (p *Pool) bootInstance(q *QemuSystem) error {
+	if err := q.Start(); err != nil {
+		return err
+	}
+	return q.WaitForBoot(p.bootTimeout())
+}
+
+func (p *Pool) bootTimeout() time.Duration {
+	if p.cfg.BootTimeout != 0 {
+		return p.cfg.BootTimeout
+	}
+	return defaultPoolBootTimeout
+}
+
+// Acquire blocks until a VM is free or ctx is done and returns it along
+// with a release func the caller must call when done so the instance goes
+// back into rotation. A dead/panicked/timed-out instance, or one that
+// fails to (re)start or boot, is torn down and replaced before being
+// handed back out. A healthy instance is booted on its first checkout and
+// reused without rebooting after that: if its post-boot snapshot was saved
+// on that first boot, every later checkout resets it via LoadSnapshot;
+// if saving the snapshot failed, later checkouts get it in whatever state
+// the previous caller left it.
+func (p *Pool) Acquire(ctx context.Context) (q *QemuSystem, release func(), err error) {
+	select {
+	case inst := <-p.free:
+		if inst.q.Died || inst.q.KernelPanic || inst.q.KilledByTimeout {
+			if inst, err = p.recycle(inst); err != nil {
+				atomic.AddInt32(&p.lost, 1)
+				return nil, nil, err
+			}
+		}
+
+		if inst.q.cmd == nil {
+			if err = p.bootInstanceFn(inst.q); err != nil {
+				return p.returnBroken(inst, err)
+			}
+
+			if saveErr := inst.q.SaveSnapshot(poolSnapshotName); saveErr == nil {
+				inst.snapshotted = true
+			}
+		} else if inst.snapshotted {
+			if err = inst.q.LoadSnapshot(poolSnapshotName); err != nil {
+				return p.returnBroken(inst, err)
+			}
+		}
+
+		released := false
+		release = func() {
+			if released {
+				return
+			}
+			released = true
+			p.free <- inst
+		}
+
+		return inst.q, release, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// Close stops every VM in the pool and removes its overlay. It must only
+// be called once all Acquired instances have been released.
+func (p *Pool) Close() {
+	want := cap(p.free) - int(atomic.LoadInt32(&p.lost))
+	for i := 0; i < want; i++ {
+		inst := <-p.free
+		inst.teardown()
+	}
+}
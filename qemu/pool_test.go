@@ -0,0 +1,112 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package qemukernel
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakeInstance builds a poolInstance whose QemuSystem never touches a real
+// qemu process, so Acquire's recycle/boot state machine can be driven
+// directly.
+func fakeInstance() *poolInstance {
+	return &poolInstance{q: &QemuSystem{}}
+}
+
+func newTestPool(t *testing.T, inst *poolInstance) *Pool {
+	t.Helper()
+
+	p := &Pool{free: make(chan *poolInstance, 1)}
+	p.newInstanceFn = func() (*poolInstance, error) { return fakeInstance(), nil }
+	p.bootInstanceFn = func(q *QemuSystem) error { return nil }
+	p.free <- inst
+
+	return p
+}
+
+func TestPoolAcquireRecyclesDeadInstance(t *testing.T) {
+	dead := fakeInstance()
+	dead.q.Died = true
+
+	p := newTestPool(t, dead)
+
+	q, release, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+	if q == dead.q {
+		t.Fatal("Acquire() handed back the dead instance instead of a recycled one")
+	}
+	release()
+}
+
+func TestPoolAcquireRecyclesKernelPanickedInstance(t *testing.T) {
+	panicked := fakeInstance()
+	panicked.q.KernelPanic = true
+
+	p := newTestPool(t, panicked)
+
+	q, release, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+	if q == panicked.q {
+		t.Fatal("Acquire() handed back the panicked instance instead of a recycled one")
+	}
+	release()
+}
+
+func TestPoolAcquireRecyclesOnBootFailureInsteadOfStickingInstance(t *testing.T) {
+	inst := fakeInstance()
+
+	p := newTestPool(t, inst)
+	bootErr := errors.New("boot timeout")
+	p.bootInstanceFn = func(q *QemuSystem) error { return bootErr }
+
+	_, _, err := p.Acquire(context.Background())
+	if err != bootErr {
+		t.Fatalf("Acquire() error = %v, want %v", err, bootErr)
+	}
+
+	// the broken instance must not have gone back to free as-is: the
+	// stuck-instance bug was that inst.q.cmd stayed nil and none of
+	// Died/KernelPanic/KilledByTimeout got set, so the next Acquire
+	// would skip both the Start/WaitForBoot branch and the recycle
+	// branch and hand the same half-booted QemuSystem back out forever.
+	select {
+	case next := <-p.free:
+		if next.q == inst.q {
+			t.Fatal("Acquire() pushed the broken instance back to free unchanged instead of recycling it")
+		}
+	default:
+		t.Fatal("Acquire() did not return a replacement instance to free after a boot failure")
+	}
+}
+
+func TestPoolAcquireReusesHealthyInstanceWithoutRebuilding(t *testing.T) {
+	healthy := fakeInstance()
+	healthy.q.cmd = nil // first checkout: still needs Start/WaitForBoot
+
+	rebuilt := false
+	p := newTestPool(t, healthy)
+	p.newInstanceFn = func() (*poolInstance, error) {
+		rebuilt = true
+		return fakeInstance(), nil
+	}
+
+	q, release, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+	if q != healthy.q {
+		t.Fatal("Acquire() rebuilt a perfectly healthy instance instead of reusing it")
+	}
+	if rebuilt {
+		t.Fatal("Acquire() called newInstanceFn for a healthy instance")
+	}
+	release()
+}
@@ -13,45 +13,95 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
-func readUntilEOF(pipe io.ReadCloser, buf *[]byte) (err error) {
-	bufSize := 1024
-	for err != io.EOF {
-		stdout := make([]byte, bufSize)
-		var n int
-
-		n, err = pipe.Read(stdout)
-		if err != nil && err != io.EOF {
-			return
-		}
-
-		*buf = append(*buf, stdout[:n]...)
-	}
-
-	if err == io.EOF {
-		err = nil
-	}
-	return
-}
-
 type arch string
 
 const (
 	// X86_64 must be exactly same as in qemu-system-${HERE}
-	X86_64 arch = "x86_64"
-	I386        = "i386"
-	// TODO add other
+	X86_64  arch = "x86_64"
+	I386         = "i386"
+	AARCH64      = "aarch64"
+	ARM          = "arm"
+	PPC64LE      = "ppc64le"
+	RISCV64      = "riscv64"
 
 	unsupported = "unsupported" // for test purposes
 )
 
+// archConfig holds the per-target defaults needed to boot a given guest arch.
+type archConfig struct {
+	Binary      string
+	DefaultArgs []string
+	Machine     string
+	CPU         string
+	Drive       string // if=... value for -drive, empty means plain -hda
+	RootDev     string // root= kernel cmdline argument
+}
+
+var archConfigs = map[arch]archConfig{
+	X86_64: {
+		Binary:  "qemu-system-x86_64",
+		RootDev: "/dev/sda",
+	},
+	I386: {
+		Binary:  "qemu-system-i386",
+		RootDev: "/dev/sda",
+	},
+	AARCH64: {
+		Binary:  "qemu-system-aarch64",
+		Machine: "virt",
+		CPU:     "cortex-a57",
+		Drive:   "virtio",
+		RootDev: "/dev/vda",
+	},
+	ARM: {
+		Binary:  "qemu-system-arm",
+		Machine: "virt",
+		CPU:     "cortex-a15",
+		Drive:   "virtio",
+		RootDev: "/dev/vda",
+	},
+	PPC64LE: {
+		// there is no "qemu-system-ppc64le" binary, ppc64le is just
+		// the little-endian variant run by qemu-system-ppc64
+		Binary:  "qemu-system-ppc64",
+		Machine: "pseries",
+		Drive:   "virtio",
+		RootDev: "/dev/vda",
+	},
+	RISCV64: {
+		Binary:  "qemu-system-riscv64",
+		Machine: "virt",
+		Drive:   "virtio",
+		RootDev: "/dev/vda",
+	},
+}
+
+// goarchToArch maps runtime.GOARCH values to the arch type used here, so
+// Start can tell whether the guest arch matches the host arch.
+var goarchToArch = map[string]arch{
+	"amd64":   X86_64,
+	"386":     I386,
+	"arm64":   AARCH64,
+	"arm":     ARM,
+	"ppc64le": PPC64LE,
+	"riscv64": RISCV64,
+}
+
+func hostArch() arch {
+	return goarchToArch[runtime.GOARCH]
+}
+
 // Kernel describe kernel parameters for qemu
 type Kernel struct {
 	Name       string
@@ -75,11 +125,37 @@ type QemuSystem struct {
 	Timeout         time.Duration
 	KilledByTimeout bool
 
-	KernelPanic bool
+	KernelPanic       bool
+	KernelPanicReport string
+
+	// BootPattern marks a successful boot once matched against a console
+	// line. Defaults to a login prompt regex.
+	BootPattern *regexp.Regexp
+	booted      chan struct{}
+
+	// PanicPatterns/OOMPatterns override the patterns used to detect a
+	// kernel oops/panic/OOM in the console output, left nil to use
+	// defaultPanicPatterns/defaultOOMPatterns.
+	PanicPatterns []PanicPattern
+	OOMPatterns   []PanicPattern
+
+	// Events carries BootEvent/PanicEvent as they're detected in the
+	// guest's console output.
+	Events chan Event
 
 	Died        bool
 	sshAddrPort string
 
+	// SSHKey is the path to the private key used to authenticate to the
+	// guest.
+	SSHKey string
+	// SSHUser is the user Command/CopyFile/etc connect as when the
+	// caller passes an empty user.
+	SSHUser string
+	// hostKey is pinned on the first successful SSH connection and
+	// checked against on every subsequent one.
+	hostKey ssh.PublicKey
+
 	// accessible while qemu is runned
 	cmd  *exec.Cmd
 	pipe struct {
@@ -88,6 +164,9 @@ type QemuSystem struct {
 		stdout io.ReadCloser
 	}
 
+	qmpSock string
+	qmp     *QMPMonitor
+
 	Stdout, Stderr []byte
 
 	// accessible after qemu is closed
@@ -96,7 +175,13 @@ type QemuSystem struct {
 
 // NewQemuSystem constructor
 func NewQemuSystem(arch arch, kernel Kernel, drivePath string) (q *QemuSystem, err error) {
-	if _, err = exec.LookPath("qemu-system-" + string(arch)); err != nil {
+	cfg, ok := archConfigs[arch]
+	if !ok {
+		err = fmt.Errorf("unsupported arch: %s", arch)
+		return
+	}
+
+	if _, err = exec.LookPath(cfg.Binary); err != nil {
 		return
 	}
 	q = &QemuSystem{}
@@ -115,6 +200,7 @@ func NewQemuSystem(arch arch, kernel Kernel, drivePath string) (q *QemuSystem, e
 	// Default values
 	q.Cpus = 1
 	q.Memory = 512 // megabytes
+	q.BootPattern = defaultBootPattern
 
 	return
 }
@@ -160,33 +246,75 @@ func kvmExists() bool {
 	return true
 }
 
-func (q *QemuSystem) panicWatcher() {
-	for {
-		time.Sleep(time.Second)
-		if bytes.Contains(q.Stdout, []byte("Kernel panic")) {
-			time.Sleep(time.Second)
-			// There is no reason to stay alive after kernel panic
-			q.Stop()
-			q.KernelPanic = true
-			return
-		}
+// driveArgs picks the -hda/-drive flag and value for drivePath under cfg,
+// factored out of Start so the per-arch drive selection can be tested
+// without spinning up qemu.
+func driveArgs(drivePath string, cfg archConfig) (flag, value string) {
+	if cfg.Drive == "" {
+		return "-hda", drivePath
+	}
+	return "-drive", fmt.Sprintf("file=%s,if=%s", drivePath, cfg.Drive)
+}
+
+// kvmCompatible reports whether a guest of guestArch can use KVM
+// acceleration on a host of hostArch: either an exact arch match, or a
+// 32-bit x86 guest on a 64-bit x86 host, since x86_64 CPUs/KVM support
+// running i386 guests.
+func kvmCompatible(guestArch, hostArch arch) bool {
+	if hostArch == guestArch {
+		return true
+	}
+	return hostArch == X86_64 && guestArch == I386
+}
+
+// qemuAccelArgs picks the acceleration (and matching -cpu) flags for a
+// guest of guestArch on a host of hostArch, factored out of Start so the
+// host/guest/GOOS/KVM combinations can be tested directly.
+func qemuAccelArgs(guestArch, hostArch arch, goos string, kvm bool) []string {
+	switch {
+	case goos == "darwin" && hostArch == guestArch:
+		return []string{"-accel", "hvf", "-cpu", "host"}
+	case kvmCompatible(guestArch, hostArch) && kvm:
+		return []string{"-enable-kvm", "-cpu", "host"}
+	default:
+		return nil
 	}
 }
 
 // Start qemu process
 func (q *QemuSystem) Start() (err error) {
 	rand.Seed(time.Now().UnixNano()) // Are you sure?
+
+	cfg, ok := archConfigs[q.arch]
+	if !ok {
+		return fmt.Errorf("unsupported arch: %s", q.arch)
+	}
+
 	q.sshAddrPort = getFreeAddrPort()
 	hostfwd := fmt.Sprintf("hostfwd=tcp:%s-:22", q.sshAddrPort)
+
+	driveFlag, driveArg := driveArgs(q.drivePath, cfg)
+
 	qemuArgs := []string{"-snapshot", "-nographic",
-		"-hda", q.drivePath,
+		driveFlag, driveArg,
 		"-kernel", q.kernel.KernelPath,
-		"-append", "root=/dev/sda ignore_loglevel console=ttyS0 rw",
+		"-append", fmt.Sprintf("root=%s ignore_loglevel console=ttyS0 rw", cfg.RootDev),
 		"-smp", fmt.Sprintf("%d", q.Cpus),
 		"-m", fmt.Sprintf("%d", q.Memory),
 		"-device", "e1000,netdev=n1",
 		"-netdev", "user,id=n1," + hostfwd,
 	}
+	qemuArgs = append(qemuArgs, cfg.DefaultArgs...)
+
+	if cfg.Machine != "" {
+		qemuArgs = append(qemuArgs, "-machine", cfg.Machine)
+	}
+
+	if accelArgs := qemuAccelArgs(q.arch, hostArch(), runtime.GOOS, kvmExists()); accelArgs != nil {
+		qemuArgs = append(qemuArgs, accelArgs...)
+	} else if cfg.CPU != "" {
+		qemuArgs = append(qemuArgs, "-cpu", cfg.CPU)
+	}
 
 	if q.debug {
 		qemuArgs = append(qemuArgs, "-gdb", q.gdb)
@@ -196,15 +324,11 @@ func (q *QemuSystem) Start() (err error) {
 		qemuArgs = append(qemuArgs, "-initrd", q.kernel.InitrdPath)
 	}
 
-	if (q.arch == X86_64 || q.arch == I386) && kvmExists() {
-		qemuArgs = append(qemuArgs, "-enable-kvm")
-	}
-
-	if q.arch == X86_64 && runtime.GOOS == "darwin" {
-		qemuArgs = append(qemuArgs, "-accel", "hvf", "-cpu", "host")
-	}
+	q.qmpSock = filepath.Join(os.TempDir(), fmt.Sprintf("qemu-qmp-%d.sock", rand.Int()))
+	qemuArgs = append(qemuArgs, "-qmp",
+		fmt.Sprintf("unix:%s,server=on,wait=off", q.qmpSock))
 
-	q.cmd = exec.Command("qemu-system-"+string(q.arch), qemuArgs...)
+	q.cmd = exec.Command(cfg.Binary, qemuArgs...)
 
 	if q.pipe.stdin, err = q.cmd.StdinPipe(); err != nil {
 		return
@@ -223,8 +347,9 @@ func (q *QemuSystem) Start() (err error) {
 		return
 	}
 
-	go readUntilEOF(q.pipe.stdout, &q.Stdout)
-	go readUntilEOF(q.pipe.stderr, &q.Stderr)
+	q.booted = make(chan struct{})
+	q.Events = make(chan Event, 16)
+	go q.outputWatcher()
 
 	go func() {
 		q.exitErr = q.cmd.Wait()
@@ -235,9 +360,12 @@ func (q *QemuSystem) Start() (err error) {
 
 	if q.Died {
 		err = errors.New("qemu died immediately: " + string(q.Stderr))
+		return
 	}
 
-	go q.panicWatcher()
+	if q.qmp, err = dialQMP(q.qmpSock); err != nil {
+		return
+	}
 
 	if q.Timeout != 0 {
 		go func() {
@@ -252,8 +380,13 @@ func (q *QemuSystem) Start() (err error) {
 
 // Stop qemu process
 func (q *QemuSystem) Stop() {
-	// 1  00/01   01  01  SOH  (Ctrl-A)  START OF HEADING
-	fmt.Fprintf(q.pipe.stdin, "%cx", 1)
+	if q.qmp != nil {
+		q.Quit()
+	} else {
+		// 1  00/01   01  01  SOH  (Ctrl-A)  START OF HEADING
+		fmt.Fprintf(q.pipe.stdin, "%cx", 1)
+	}
+
 	// wait for die
 	time.Sleep(time.Second / 10)
 	if !q.Died {
@@ -261,20 +394,78 @@ func (q *QemuSystem) Stop() {
 		time.Sleep(time.Second / 10)
 		q.cmd.Process.Signal(syscall.SIGKILL)
 	}
+
+	if q.qmp != nil {
+		q.qmp.Close()
+	}
+}
+
+// hostKeyCallback pins the guest key on first connect (we have no prior
+// known_hosts entry for a freshly booted VM) and verifies it on every
+// connection after that, instead of trusting InsecureIgnoreHostKey forever.
+func (q *QemuSystem) hostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if q.hostKey == nil {
+		q.hostKey = key
+		return nil
+	}
+
+	if !bytes.Equal(q.hostKey.Marshal(), key.Marshal()) {
+		return fmt.Errorf("ssh: host key for %s changed since first connect", hostname)
+	}
+
+	return nil
 }
 
-func (q QemuSystem) ssh(user string) (client *ssh.Client, err error) {
+func (q *QemuSystem) ssh(user string) (client *ssh.Client, err error) {
+	if user == "" {
+		user = q.SSHUser
+	}
+
 	cfg := &ssh.ClientConfig{
 		User:            user,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: q.hostKeyCallback,
+	}
+
+	if q.SSHKey != "" {
+		key, err := os.ReadFile(q.SSHKey)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
 	}
 
 	client, err = ssh.Dial("tcp", q.sshAddrPort, cfg)
 	return
 }
 
+// WaitForSSH blocks until the guest starts accepting TCP connections on its
+// forwarded SSH port, or timeout elapses, so callers stop racing the boot.
+func (q *QemuSystem) WaitForSSH(timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, dialErr := net.DialTimeout("tcp", q.sshAddrPort, time.Second)
+		if dialErr == nil {
+			conn.Close()
+			return nil
+		}
+		err = dialErr
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("waiting for ssh on %s: %w", q.sshAddrPort, err)
+		}
+
+		time.Sleep(time.Second / 10)
+	}
+}
+
 // Command executes shell commands on qemu system
-func (q QemuSystem) Command(user, cmd string) (output string, err error) {
+func (q *QemuSystem) Command(user, cmd string) (output string, err error) {
 	client, err := q.ssh(user)
 	if err != nil {
 		return
@@ -292,7 +483,7 @@ func (q QemuSystem) Command(user, cmd string) (output string, err error) {
 }
 
 // AsyncCommand executes command on qemu system but does not wait for exit
-func (q QemuSystem) AsyncCommand(user, cmd string) (err error) {
+func (q *QemuSystem) AsyncCommand(user, cmd string) (err error) {
 	client, err := q.ssh(user)
 	if err != nil {
 		return
@@ -308,21 +499,34 @@ func (q QemuSystem) AsyncCommand(user, cmd string) (err error) {
 		"nohup sh -c '%s' > /dev/null 2> /dev/null < /dev/null &", cmd))
 }
 
-// CopyFile is copy file from local machine to remote through ssh/scp
+// CopyFile copies a local file to the guest over sftp, replacing the
+// previous shell-out to the external scp binary.
 func (q *QemuSystem) CopyFile(user, localPath, remotePath string) (err error) {
-	addrPort := strings.Split(q.sshAddrPort, ":")
-	addr := addrPort[0]
-	port := addrPort[1]
+	client, err := q.ssh(user)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		return
+	}
+	defer sc.Close()
 
-	cmd := exec.Command("scp", "-P", port,
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "LogLevel=error",
-		localPath, user+"@"+addr+":"+remotePath)
-	output, err := cmd.CombinedOutput()
+	local, err := os.Open(localPath)
 	if err != nil {
-		return errors.New(string(output))
+		return
+	}
+	defer local.Close()
+
+	remote, err := sc.Create(remotePath)
+	if err != nil {
+		return
 	}
+	defer remote.Close()
 
+	_, err = io.Copy(remote, local)
 	return
 }
 
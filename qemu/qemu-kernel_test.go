@@ -0,0 +1,79 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package qemukernel
+
+import "testing"
+
+func TestDriveArgs(t *testing.T) {
+	cases := []struct {
+		name      string
+		cfg       archConfig
+		wantFlag  string
+		wantValue string
+	}{
+		{"plain hda", archConfigs[X86_64], "-hda", "/tmp/disk.img"},
+		{"virtio drive", archConfigs[AARCH64], "-drive", "file=/tmp/disk.img,if=virtio"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			flag, value := driveArgs("/tmp/disk.img", c.cfg)
+			if flag != c.wantFlag || value != c.wantValue {
+				t.Errorf("driveArgs() = (%q, %q), want (%q, %q)", flag, value, c.wantFlag, c.wantValue)
+			}
+		})
+	}
+}
+
+func TestKvmCompatible(t *testing.T) {
+	cases := []struct {
+		guest, host arch
+		want        bool
+	}{
+		{X86_64, X86_64, true},
+		{I386, X86_64, true},
+		{X86_64, I386, false},
+		{AARCH64, X86_64, false},
+		{AARCH64, AARCH64, true},
+		{ARM, AARCH64, false},
+	}
+
+	for _, c := range cases {
+		if got := kvmCompatible(c.guest, c.host); got != c.want {
+			t.Errorf("kvmCompatible(%s, %s) = %v, want %v", c.guest, c.host, got, c.want)
+		}
+	}
+}
+
+func TestQemuAccelArgs(t *testing.T) {
+	cases := []struct {
+		name        string
+		guest, host arch
+		goos        string
+		kvm         bool
+		want        []string
+	}{
+		{"i386 guest on amd64 host with kvm uses kvm", I386, X86_64, "linux", true, []string{"-enable-kvm", "-cpu", "host"}},
+		{"x86_64 guest on x86_64 host with kvm uses kvm", X86_64, X86_64, "linux", true, []string{"-enable-kvm", "-cpu", "host"}},
+		{"x86_64 guest on x86_64 host without kvm falls back to tcg", X86_64, X86_64, "linux", false, nil},
+		{"mismatched arch never gets kvm", AARCH64, X86_64, "linux", true, nil},
+		{"darwin host uses hvf on exact arch match", AARCH64, AARCH64, "darwin", false, []string{"-accel", "hvf", "-cpu", "host"}},
+		{"darwin host with mismatched arch gets no accel", AARCH64, X86_64, "darwin", false, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := qemuAccelArgs(c.guest, c.host, c.goos, c.kvm)
+			if len(got) != len(c.want) {
+				t.Fatalf("qemuAccelArgs() = %v, want %v", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Fatalf("qemuAccelArgs() = %v, want %v", got, c.want)
+				}
+			}
+		})
+	}
+}
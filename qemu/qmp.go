@@ -0,0 +1,269 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package qemukernel
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// qmpGreeting is the {"QMP": {...}} message qemu sends right after the
+// monitor socket is accepted.
+type qmpGreeting struct {
+	QMP struct {
+		Version      json.RawMessage `json:"version"`
+		Capabilities []string        `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+// qmpEvent is an asynchronous {"event": ...} message.
+type qmpEvent struct {
+	Event string                 `json:"event"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+// qmpResponse is a {"return": ...} or {"error": ...} reply to a command,
+// correlated back to its caller by ID.
+type qmpResponse struct {
+	ID     int64           `json:"id,omitempty"`
+	Return json.RawMessage `json:"return,omitempty"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error,omitempty"`
+}
+
+// qmpCommand is a {"execute": ..., "arguments": ...} request.
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+	ID        int64       `json:"id,omitempty"`
+}
+
+// QMPMonitor is a client for the QEMU Machine Protocol, connected over the
+// unix socket passed to qemu via "-qmp unix:<path>,server=on,wait=off".
+type QMPMonitor struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMu sync.Mutex
+	nextID  int64
+
+	pendingMu sync.Mutex
+	pending   map[int64]chan qmpResponse
+
+	// Events carries QMP events ({"event": ...} messages) as they arrive.
+	Events chan qmpEvent
+}
+
+// dialQMP connects to the QMP unix socket, reads the initial greeting and
+// negotiates capabilities, then starts the background dispatcher.
+func dialQMP(sock string) (mon *QMPMonitor, err error) {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return
+	}
+
+	mon = &QMPMonitor{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		pending: make(map[int64]chan qmpResponse),
+		Events:  make(chan qmpEvent, 16),
+	}
+
+	var greeting qmpGreeting
+	if err = mon.readJSON(&greeting); err != nil {
+		return nil, err
+	}
+
+	go mon.dispatch()
+
+	if _, err = mon.execute("qmp_capabilities", nil); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (mon *QMPMonitor) readJSON(v interface{}) error {
+	line, err := mon.reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+// dispatch reads line-delimited JSON off the QMP socket, routing
+// {"event":...} messages to Events and {"return":...}/{"error":...}
+// replies to the execute() call waiting on the matching id.
+func (mon *QMPMonitor) dispatch() {
+	for {
+		line, err := mon.reader.ReadBytes('\n')
+		if err != nil {
+			mon.abortPending(err)
+			close(mon.Events)
+			return
+		}
+
+		var probe struct {
+			Event string `json:"event"`
+		}
+		if json.Unmarshal(line, &probe) == nil && probe.Event != "" {
+			var ev qmpEvent
+			if json.Unmarshal(line, &ev) == nil {
+				select {
+				case mon.Events <- ev:
+				default: // drop if nobody is listening
+				}
+			}
+			continue
+		}
+
+		var resp qmpResponse
+		if json.Unmarshal(line, &resp) != nil {
+			continue
+		}
+
+		mon.pendingMu.Lock()
+		ch, ok := mon.pending[resp.ID]
+		delete(mon.pending, resp.ID)
+		mon.pendingMu.Unlock()
+
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+// abortPending fails every in-flight execute() call once the socket is
+// gone, so a command sent right before qemu exits doesn't block its caller
+// forever waiting on a reply that will never arrive.
+func (mon *QMPMonitor) abortPending(err error) {
+	mon.pendingMu.Lock()
+	pending := mon.pending
+	mon.pending = make(map[int64]chan qmpResponse)
+	mon.pendingMu.Unlock()
+
+	errClass := &struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	}{Class: "ConnectionClosed", Desc: err.Error()}
+
+	for _, ch := range pending {
+		ch <- qmpResponse{Error: errClass}
+	}
+}
+
+func (mon *QMPMonitor) execute(cmd string, args interface{}) (json.RawMessage, error) {
+	id := atomic.AddInt64(&mon.nextID, 1)
+	ch := make(chan qmpResponse, 1)
+
+	mon.pendingMu.Lock()
+	mon.pending[id] = ch
+	mon.pendingMu.Unlock()
+
+	enc, err := json.Marshal(qmpCommand{Execute: cmd, Arguments: args, ID: id})
+	if err != nil {
+		return nil, err
+	}
+	enc = append(enc, '\n')
+
+	mon.writeMu.Lock()
+	_, err = mon.conn.Write(enc)
+	mon.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := <-ch
+	if resp.Error != nil {
+		return nil, fmt.Errorf("qmp: %s: %s", resp.Error.Class, resp.Error.Desc)
+	}
+	return resp.Return, nil
+}
+
+// Close closes the underlying QMP socket.
+func (mon *QMPMonitor) Close() error {
+	return mon.conn.Close()
+}
+
+// SaveSnapshot saves the whole VM state (RAM, device state and disk) under
+// name, so a later LoadSnapshot can resume from it instead of paying boot
+// cost again.
+func (q *QemuSystem) SaveSnapshot(name string) error {
+	_, err := q.HumanMonitorCommand("savevm " + name)
+	return err
+}
+
+// LoadSnapshot restores VM state previously stored by SaveSnapshot.
+func (q *QemuSystem) LoadSnapshot(name string) error {
+	_, err := q.HumanMonitorCommand("loadvm " + name)
+	return err
+}
+
+// Quit asks qemu to exit cleanly over QMP.
+func (q *QemuSystem) Quit() error {
+	if q.qmp == nil {
+		return errors.New("qmp: not connected")
+	}
+	_, err := q.qmp.execute("quit", nil)
+	return err
+}
+
+// SystemReset performs a hard reset of the guest.
+func (q *QemuSystem) SystemReset() error {
+	if q.qmp == nil {
+		return errors.New("qmp: not connected")
+	}
+	_, err := q.qmp.execute("system_reset", nil)
+	return err
+}
+
+// DeviceAdd hotplugs a device of the given qdev driver, with props holding
+// its properties (id, netdev, bus, ...).
+func (q *QemuSystem) DeviceAdd(driver string, props map[string]interface{}) error {
+	if q.qmp == nil {
+		return errors.New("qmp: not connected")
+	}
+
+	args := map[string]interface{}{"driver": driver}
+	for k, v := range props {
+		args[k] = v
+	}
+
+	_, err := q.qmp.execute("device_add", args)
+	return err
+}
+
+// DeviceDel unplugs a previously hotplugged device by id.
+func (q *QemuSystem) DeviceDel(id string) error {
+	if q.qmp == nil {
+		return errors.New("qmp: not connected")
+	}
+	_, err := q.qmp.execute("device_del", map[string]interface{}{"id": id})
+	return err
+}
+
+// HumanMonitorCommand runs cmd as if typed at the qemu HMP console and
+// returns its textual output.
+func (q *QemuSystem) HumanMonitorCommand(cmd string) (output string, err error) {
+	if q.qmp == nil {
+		return "", errors.New("qmp: not connected")
+	}
+
+	raw, err := q.qmp.execute("human-monitor-command",
+		map[string]interface{}{"command-line": cmd})
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, &output)
+	return
+}
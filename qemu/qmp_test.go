@@ -0,0 +1,160 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package qemukernel
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestMonitorPair(t *testing.T) (mon *QMPMonitor, server *bufio.ReadWriter, serverConn net.Conn) {
+	t.Helper()
+
+	client, srv := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		srv.Close()
+	})
+
+	mon = &QMPMonitor{
+		conn:    client,
+		reader:  bufio.NewReader(client),
+		pending: make(map[int64]chan qmpResponse),
+		Events:  make(chan qmpEvent, 16),
+	}
+	go mon.dispatch()
+
+	return mon, bufio.NewReadWriter(bufio.NewReader(srv), bufio.NewWriter(srv)), srv
+}
+
+func TestQMPMonitorExecuteCorrelatesByID(t *testing.T) {
+	mon, server, _ := newTestMonitorPair(t)
+
+	done := make(chan error, 1)
+	go func() {
+		line, err := server.ReadBytes('\n')
+		if err != nil {
+			done <- err
+			return
+		}
+
+		var cmd qmpCommand
+		if err := json.Unmarshal(line, &cmd); err != nil {
+			done <- err
+			return
+		}
+		if cmd.Execute != "query-status" {
+			done <- errUnexpected(cmd.Execute)
+			return
+		}
+
+		resp := qmpResponse{ID: cmd.ID, Return: json.RawMessage(`{"status":"running"}`)}
+		enc, _ := json.Marshal(resp)
+		enc = append(enc, '\n')
+		if _, err := server.Write(enc); err != nil {
+			done <- err
+			return
+		}
+		done <- server.Flush()
+	}()
+
+	raw, err := mon.execute("query-status", nil)
+	if err != nil {
+		t.Fatalf("execute() error: %v", err)
+	}
+
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(raw, &status); err != nil {
+		t.Fatalf("unmarshal return: %v", err)
+	}
+	if status.Status != "running" {
+		t.Errorf("status = %q, want %q", status.Status, "running")
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("server side: %v", err)
+	}
+}
+
+func TestQMPMonitorExecuteReturnsServerError(t *testing.T) {
+	mon, server, _ := newTestMonitorPair(t)
+
+	go func() {
+		line, err := server.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		var cmd qmpCommand
+		json.Unmarshal(line, &cmd)
+
+		resp := qmpResponse{ID: cmd.ID, Error: &struct {
+			Class string `json:"class"`
+			Desc  string `json:"desc"`
+		}{Class: "GenericError", Desc: "boom"}}
+		enc, _ := json.Marshal(resp)
+		server.Write(append(enc, '\n'))
+		server.Flush()
+	}()
+
+	_, err := mon.execute("quit", nil)
+	if err == nil {
+		t.Fatal("execute() returned no error for a QMP error reply")
+	}
+}
+
+func TestQMPMonitorRoutesEvents(t *testing.T) {
+	mon, server, _ := newTestMonitorPair(t)
+
+	enc, _ := json.Marshal(qmpEvent{Event: "RESET"})
+	server.Write(append(enc, '\n'))
+	server.Flush()
+
+	select {
+	case ev := <-mon.Events:
+		if ev.Event != "RESET" {
+			t.Errorf("Event = %q, want %q", ev.Event, "RESET")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+func TestQMPMonitorAbortsPendingOnDisconnect(t *testing.T) {
+	mon, server, serverConn := newTestMonitorPair(t)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := mon.execute("quit", nil)
+		done <- err
+	}()
+
+	// read the command off the wire so execute() is left pending on its
+	// reply (net.Pipe writes block until read), then yank the connection
+	// out from under it
+	if _, err := server.ReadBytes('\n'); err != nil {
+		t.Fatalf("server side: %v", err)
+	}
+	serverConn.Close()
+	mon.conn.Close()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("execute() returned no error after the connection closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("execute() never returned after the connection closed (dispatch didn't abort pending callers)")
+	}
+}
+
+type errUnexpected string
+
+func (e errUnexpected) Error() string { return "unexpected command: " + string(e) }